@@ -0,0 +1,171 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package config defines the configuration surface for the kms plugin's
+// Azure Key Vault backend.
+package config
+
+import "fmt"
+
+// Algorithm identifies a Key Vault key operation algorithm that the plugin
+// is configured to use for wrap/unwrap or direct encrypt/decrypt calls.
+type Algorithm string
+
+const (
+	// AlgorithmRSA15 is the legacy RSAES-PKCS1-v1_5 algorithm. It is limited
+	// to encrypting payloads smaller than the RSA key size and is retained
+	// only for backwards compatibility with existing deployments.
+	AlgorithmRSA15 Algorithm = "RSA1_5"
+	// AlgorithmRSAOAEP is RSAES-OAEP using SHA-1.
+	AlgorithmRSAOAEP Algorithm = "RSA-OAEP"
+	// AlgorithmRSAOAEP256 is RSAES-OAEP using SHA-256 and is the recommended
+	// default for software and HSM-protected RSA keys.
+	AlgorithmRSAOAEP256 Algorithm = "RSA-OAEP-256"
+	// AlgorithmA256KW is AES key wrap with a 256-bit key, only available for
+	// oct-HSM keys backed by Managed HSM.
+	AlgorithmA256KW Algorithm = "A256KW"
+)
+
+// Backend selects which KMS implementation the plugin serves
+// encrypt/decrypt requests from.
+type Backend string
+
+const (
+	// BackendAzureKeyVault uses Azure Key Vault or Managed HSM.
+	BackendAzureKeyVault Backend = "azure-keyvault"
+	// BackendVaultTransit uses HashiCorp Vault's Transit secrets engine.
+	BackendVaultTransit Backend = "vault-transit"
+)
+
+// ValidateBackend checks that backend is one of the supported values,
+// defaulting an empty value to BackendAzureKeyVault for backwards
+// compatibility with configs predating the vault-transit backend.
+func ValidateBackend(backend Backend) (Backend, error) {
+	switch backend {
+	case "":
+		return BackendAzureKeyVault, nil
+	case BackendAzureKeyVault, BackendVaultTransit:
+		return backend, nil
+	default:
+		return "", fmt.Errorf("unsupported backend: %s", backend)
+	}
+}
+
+// AzureConfig holds the configuration used to construct the Key Vault
+// client and to drive the plugin's encryption behavior.
+type AzureConfig struct {
+	// Backend selects which KMS implementation the plugin serves
+	// encrypt/decrypt requests from. When empty it defaults to
+	// BackendAzureKeyVault.
+	Backend Backend `json:"backend" yaml:"backend"`
+
+	// Cloud is the Azure cloud environment name, e.g. AzurePublicCloud.
+	Cloud string `json:"cloud" yaml:"cloud"`
+
+	// KeyURI, when set, configures the primary key as a single
+	// azurekms:vault=...;name=...?version=... URI instead of separate
+	// vaultName/keyName/keyVersion fields, resolving the key's current
+	// enabled version against Key Vault when the URI doesn't specify one.
+	// It takes precedence over the discrete vaultName/keyName/keyVersion
+	// arguments passed to NewClient.
+	KeyURI string `json:"keyURI" yaml:"keyURI"`
+
+	// Algorithm is the Key Vault key operation algorithm to use. When empty
+	// it defaults to AlgorithmRSA15 for backwards compatibility.
+	Algorithm Algorithm `json:"algorithm" yaml:"algorithm"`
+
+	// Envelope, when true, enables envelope encryption: payloads are
+	// encrypted locally with a generated data-encryption key (DEK) and only
+	// the DEK is wrapped/unwrapped through Key Vault.
+	Envelope bool `json:"envelope" yaml:"envelope"`
+
+	// DEKCacheTTLSeconds controls how long a generated DEK is reused for
+	// new encryptions before a fresh one is wrapped through Key Vault. A
+	// value of 0 disables caching and wraps a new DEK on every call.
+	DEKCacheTTLSeconds int `json:"dekCacheTTLSeconds" yaml:"dekCacheTTLSeconds"`
+
+	// Transit holds the HashiCorp Vault Transit backend configuration,
+	// used when Backend is BackendVaultTransit.
+	Transit TransitConfig `json:"transit" yaml:"transit"`
+
+	// Rotation configures the KeyRing's secondary keys and automatic
+	// primary-key promotion. It's optional: a config that leaves it unset
+	// still gets a one-entry KeyRing around the primary key, it just never
+	// promotes anything on its own.
+	Rotation RotationConfig `json:"rotation" yaml:"rotation"`
+}
+
+// KeyReference identifies a single Key Vault key version, used to
+// configure a KeyRing's secondary (decrypt-only) keys.
+type KeyReference struct {
+	VaultName  string `json:"vaultName" yaml:"vaultName"`
+	KeyName    string `json:"keyName" yaml:"keyName"`
+	KeyVersion string `json:"keyVersion" yaml:"keyVersion"`
+}
+
+// RotationConfig configures a KeyRing's secondary keys and the
+// RotationController that watches the primary key for a new version.
+type RotationConfig struct {
+	// SecondaryKeys remain usable for decryption alongside the primary key
+	// configured via vaultName/keyName/keyVersion, so already-written
+	// ciphertext stays decryptable across a key rotation.
+	SecondaryKeys []KeyReference `json:"secondaryKeys" yaml:"secondaryKeys"`
+
+	// PollIntervalSeconds is how often to check Key Vault for a new
+	// primary key version. A value of 0 disables automatic rotation: the
+	// plugin keeps encrypting with the configured key until restarted
+	// with a new one.
+	PollIntervalSeconds int `json:"pollIntervalSeconds" yaml:"pollIntervalSeconds"`
+
+	// GracePeriodSeconds is how long a newly observed key version must
+	// remain the latest before it's promoted to primary, to avoid
+	// promoting a version Key Vault is still propagating.
+	GracePeriodSeconds int `json:"gracePeriodSeconds" yaml:"gracePeriodSeconds"`
+}
+
+// TransitConfig holds the configuration needed to talk to a HashiCorp
+// Vault Transit secrets engine, mirroring transit.Config so CLI/config
+// wiring doesn't need to import the plugin package.
+type TransitConfig struct {
+	// Address is the Vault server address, e.g. https://vault.example.com:8200.
+	Address string `json:"address" yaml:"address"`
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string `json:"namespace" yaml:"namespace"`
+	// KeyName is the name of the transit key to encrypt/decrypt with.
+	KeyName string `json:"keyName" yaml:"keyName"`
+	// MountPath is the path the transit secrets engine is mounted at.
+	// Defaults to "transit".
+	MountPath string `json:"mountPath" yaml:"mountPath"`
+
+	// AuthMethod is "approle" or "kubernetes".
+	AuthMethod string `json:"authMethod" yaml:"authMethod"`
+
+	// AppRole fields, required when AuthMethod is "approle".
+	AppRoleMountPath string `json:"appRoleMountPath" yaml:"appRoleMountPath"`
+	AppRoleID        string `json:"appRoleID" yaml:"appRoleID"`
+	AppRoleSecretID  string `json:"appRoleSecretID" yaml:"appRoleSecretID"`
+
+	// Kubernetes auth fields, required when AuthMethod is "kubernetes".
+	KubernetesMountPath string `json:"kubernetesMountPath" yaml:"kubernetesMountPath"`
+	KubernetesRole      string `json:"kubernetesRole" yaml:"kubernetesRole"`
+	KubernetesJWTPath   string `json:"kubernetesJWTPath" yaml:"kubernetesJWTPath"`
+}
+
+// ValidateAlgorithm checks that algo is a supported algorithm for a key of
+// the given protection level, mirroring the set of algorithms Key Vault
+// itself accepts for software keys versus Managed HSM keys.
+func ValidateAlgorithm(algo Algorithm, managedHSM bool) error {
+	switch algo {
+	case "", AlgorithmRSA15, AlgorithmRSAOAEP, AlgorithmRSAOAEP256:
+		return nil
+	case AlgorithmA256KW:
+		if !managedHSM {
+			return fmt.Errorf("algorithm %s is only supported for managed HSM keys", algo)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm: %s", algo)
+	}
+}
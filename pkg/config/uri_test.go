@@ -0,0 +1,176 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package config
+
+import "testing"
+
+func TestParseKeyURI(t *testing.T) {
+	cases := []struct {
+		name    string
+		uri     string
+		want    *KeyURI
+		wantErr bool
+	}{
+		{
+			name: "vault and name only",
+			uri:  "azurekms:vault=myvault;name=mykey",
+			want: &KeyURI{VaultName: "myvault", KeyName: "mykey"},
+		},
+		{
+			name: "version hsm and protection",
+			uri:  "azurekms:vault=myvault;name=mykey?version=abcdef&hsm=true&protection=hsm",
+			want: &KeyURI{VaultName: "myvault", KeyName: "mykey", KeyVersion: "abcdef", HSM: true, ProtectionLevel: ProtectionLevelHSM},
+		},
+		{
+			name: "protection software",
+			uri:  "azurekms:vault=myvault;name=mykey?protection=software",
+			want: &KeyURI{VaultName: "myvault", KeyName: "mykey", ProtectionLevel: ProtectionLevelSoftware},
+		},
+		{
+			name:    "wrong scheme",
+			uri:     "notakms:vault=myvault;name=mykey",
+			wantErr: true,
+		},
+		{
+			name:    "missing name",
+			uri:     "azurekms:vault=myvault",
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			uri:     "azurekms:vault=myvault;name=mykey;bogus=1",
+			wantErr: true,
+		},
+		{
+			name:    "invalid hsm bool",
+			uri:     "azurekms:vault=myvault;name=mykey?hsm=notabool",
+			wantErr: true,
+		},
+		{
+			name:    "invalid protection level",
+			uri:     "azurekms:vault=myvault;name=mykey?protection=bogus",
+			wantErr: true,
+		},
+		{
+			name: "auth mode",
+			uri:  "azurekms:vault=myvault;name=mykey?auth=workload-identity",
+			want: &KeyURI{VaultName: "myvault", KeyName: "mykey", AuthMode: AuthModeWorkloadIdentity},
+		},
+		{
+			name:    "invalid auth mode",
+			uri:     "azurekms:vault=myvault;name=mykey?auth=bogus",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseKeyURI(tc.uri)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("ParseKeyURI(%q) error = nil, want error", tc.uri)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseKeyURI(%q) error = %v", tc.uri, err)
+			}
+			if *got != *tc.want {
+				t.Fatalf("ParseKeyURI(%q) = %+v, want %+v", tc.uri, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestKeyURIStringRoundTrip(t *testing.T) {
+	cases := []string{
+		"azurekms:vault=myvault;name=mykey",
+		"azurekms:vault=myvault;name=mykey?version=abcdef",
+		"azurekms:vault=myvault;name=mykey?version=abcdef&hsm=true&protection=hsm",
+		"azurekms:vault=myvault;name=mykey?auth=client-cert",
+	}
+
+	for _, uri := range cases {
+		t.Run(uri, func(t *testing.T) {
+			parsed, err := ParseKeyURI(uri)
+			if err != nil {
+				t.Fatalf("ParseKeyURI(%q) error = %v", uri, err)
+			}
+
+			reparsed, err := ParseKeyURI(parsed.String())
+			if err != nil {
+				t.Fatalf("ParseKeyURI(%q) error = %v", parsed.String(), err)
+			}
+			if *reparsed != *parsed {
+				t.Fatalf("round trip mismatch: %+v != %+v", reparsed, parsed)
+			}
+		})
+	}
+}
+
+func TestKeyURIIsHSM(t *testing.T) {
+	cases := []struct {
+		name string
+		uri  *KeyURI
+		want bool
+	}{
+		{name: "neither set", uri: &KeyURI{}, want: false},
+		{name: "hsm flag", uri: &KeyURI{HSM: true}, want: true},
+		{name: "protection hsm", uri: &KeyURI{ProtectionLevel: ProtectionLevelHSM}, want: true},
+		{name: "protection software", uri: &KeyURI{ProtectionLevel: ProtectionLevelSoftware}, want: false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.uri.IsHSM(); got != tc.want {
+				t.Fatalf("IsHSM() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestKeyURIFromKid(t *testing.T) {
+	cases := []struct {
+		name    string
+		kid     string
+		want    *KeyURI
+		wantErr bool
+	}{
+		{
+			name: "versioned kid",
+			kid:  "https://myvault.vault.azure.net/keys/mykey/abcdef",
+			want: &KeyURI{VaultName: "myvault", KeyName: "mykey", KeyVersion: "abcdef"},
+		},
+		{
+			name: "unversioned kid",
+			kid:  "https://myvault.vault.azure.net/keys/mykey",
+			want: &KeyURI{VaultName: "myvault", KeyName: "mykey"},
+		},
+		{
+			name:    "missing keys segment",
+			kid:     "https://myvault.vault.azure.net/secrets/mykey",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := KeyURIFromKid(tc.kid)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("KeyURIFromKid(%q) error = nil, want error", tc.kid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("KeyURIFromKid(%q) error = %v", tc.kid, err)
+			}
+			if *got != *tc.want {
+				t.Fatalf("KeyURIFromKid(%q) = %+v, want %+v", tc.kid, got, tc.want)
+			}
+		})
+	}
+}
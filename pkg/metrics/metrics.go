@@ -0,0 +1,219 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package metrics instruments the plugin's encrypt/decrypt paths with
+// OpenTelemetry metrics and tracing, and exposes a CLI-configurable
+// exporter so operators get actionable SLIs for KMS latency without
+// running a separate sidecar.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/pflag"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ExporterPrometheus exposes a pull-based /metrics endpoint.
+	ExporterPrometheus = "prometheus"
+	// ExporterOTLP pushes metrics to an OTLP collector.
+	ExporterOTLP = "otlp"
+
+	instrumentationName = "github.com/Azure/kubernetes-kms"
+
+	// maxRecordedPayloadSize bounds the payload size attribute recorded on
+	// spans so unusually large requests don't blow up cardinality or leak
+	// size information beyond what's useful for SLIs.
+	maxRecordedPayloadSize = 1 << 20 // 1 MiB
+)
+
+// Options are the CLI flags that configure metrics and tracing.
+type Options struct {
+	Exporter       string
+	OTLPEndpoint   string
+	MetricsAddress string
+}
+
+// AddFlags registers the metrics CLI flags on fs.
+func (o *Options) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.Exporter, "metrics-backend", ExporterPrometheus, "metrics backend to use: prometheus or otlp")
+	fs.StringVar(&o.OTLPEndpoint, "otlp-endpoint", "", "OTLP gRPC collector endpoint, required when --metrics-backend=otlp")
+	fs.StringVar(&o.MetricsAddress, "metrics-address", ":8095", "address the /metrics HTTP listener binds to")
+}
+
+var (
+	requestCount    metric.Int64Counter
+	requestDuration metric.Float64Histogram
+	errorCount      metric.Int64Counter
+	cacheHitCount   metric.Int64Counter
+	cacheMissCount  metric.Int64Counter
+	tracer          trace.Tracer
+)
+
+// Init configures the global OpenTelemetry meter provider according to
+// opts and, for the Prometheus backend, starts the /metrics HTTP listener.
+// It returns a shutdown func that flushes and stops the exporters. Spans
+// are started on the global tracer provider, which Init does not
+// configure: unless the process sets one, spans are not exported.
+func Init(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	var (
+		reader   sdkmetric.Reader
+		shutdown func(context.Context) error
+	)
+
+	switch opts.Exporter {
+	case ExporterPrometheus:
+		exporter, err := prometheus.New()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create prometheus exporter, error: %+v", err)
+		}
+		reader = exporter
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		server := &http.Server{Addr: opts.MetricsAddress, Handler: mux}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				klog.ErrorS(err, "metrics http listener exited")
+			}
+		}()
+		shutdown = server.Shutdown
+
+	case ExporterOTLP:
+		if opts.OTLPEndpoint == "" {
+			return nil, fmt.Errorf("--otlp-endpoint is required when --metrics-backend=otlp")
+		}
+		exporter, err := otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpoint(opts.OTLPEndpoint), otlpmetricgrpc.WithInsecure())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create otlp exporter, error: %+v", err)
+		}
+		reader = sdkmetric.NewPeriodicReader(exporter)
+		shutdown = exporter.Shutdown
+
+	default:
+		return nil, fmt.Errorf("unsupported metrics backend: %s", opts.Exporter)
+	}
+
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	otel.SetMeterProvider(provider)
+
+	meter := provider.Meter(instrumentationName)
+	tracer = otel.Tracer(instrumentationName)
+
+	var err error
+	if requestCount, err = meter.Int64Counter("kms_requests_total", metric.WithDescription("number of encrypt/decrypt requests")); err != nil {
+		return nil, fmt.Errorf("failed to create request counter, error: %+v", err)
+	}
+	if requestDuration, err = meter.Float64Histogram("kms_request_duration_seconds", metric.WithDescription("encrypt/decrypt request latency")); err != nil {
+		return nil, fmt.Errorf("failed to create request duration histogram, error: %+v", err)
+	}
+	if errorCount, err = meter.Int64Counter("kms_request_errors_total", metric.WithDescription("number of failed encrypt/decrypt requests by error code")); err != nil {
+		return nil, fmt.Errorf("failed to create error counter, error: %+v", err)
+	}
+	if cacheHitCount, err = meter.Int64Counter("kms_dek_cache_hits_total", metric.WithDescription("number of DEK cache hits")); err != nil {
+		return nil, fmt.Errorf("failed to create cache hit counter, error: %+v", err)
+	}
+	if cacheMissCount, err = meter.Int64Counter("kms_dek_cache_misses_total", metric.WithDescription("number of DEK cache misses")); err != nil {
+		return nil, fmt.Errorf("failed to create cache miss counter, error: %+v", err)
+	}
+
+	return func(shutdownCtx context.Context) error {
+		if provider != nil {
+			_ = provider.Shutdown(shutdownCtx)
+		}
+		if shutdown != nil {
+			return shutdown(shutdownCtx)
+		}
+		return nil
+	}, nil
+}
+
+// KeyAttributes are the identifying attributes recorded on every
+// encrypt/decrypt span and metric.
+type KeyAttributes struct {
+	VaultURL   string
+	KeyName    string
+	KeyVersion string
+	Algorithm  string
+}
+
+func (k KeyAttributes) attrs() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("vault_url", k.VaultURL),
+		attribute.String("key_name", k.KeyName),
+		attribute.String("key_version", k.KeyVersion),
+		attribute.String("algorithm", k.Algorithm),
+	}
+}
+
+// ObserveRequest starts a span for an operation ("encrypt" or "decrypt")
+// and returns a func that records its outcome, duration and (bounded)
+// payload size when called.
+func ObserveRequest(ctx context.Context, operation string, key KeyAttributes, payloadSize int) (context.Context, func(err error)) {
+	if tracer == nil {
+		return ctx, func(error) {}
+	}
+
+	recordedSize := payloadSize
+	if recordedSize > maxRecordedPayloadSize {
+		recordedSize = maxRecordedPayloadSize
+	}
+
+	attrs := append(key.attrs(), attribute.Int("payload_size_bytes", recordedSize))
+	ctx, span := tracer.Start(ctx, "kms."+operation, trace.WithAttributes(attrs...))
+	start := time.Now()
+
+	return ctx, func(err error) {
+		duration := time.Since(start).Seconds()
+		opAttrs := append(key.attrs(), attribute.String("operation", operation))
+
+		requestCount.Add(ctx, 1, metric.WithAttributes(opAttrs...))
+		requestDuration.Record(ctx, duration, metric.WithAttributes(opAttrs...))
+		if err != nil {
+			errCode := keyVaultErrorCode(err)
+			errorCount.Add(ctx, 1, metric.WithAttributes(append(opAttrs, attribute.String("error_code", errCode))...))
+			span.RecordError(err)
+		}
+		span.End()
+	}
+}
+
+// ObserveCacheAccess records a DEK cache hit or miss.
+func ObserveCacheAccess(ctx context.Context, hit bool) {
+	if hit {
+		if cacheHitCount != nil {
+			cacheHitCount.Add(ctx, 1)
+		}
+		return
+	}
+	if cacheMissCount != nil {
+		cacheMissCount.Add(ctx, 1)
+	}
+}
+
+// keyVaultErrorCode extracts the HTTP status code from a Key Vault SDK
+// error so it can be used as a low-cardinality metric label, falling back
+// to "unknown" for errors that don't carry one.
+func keyVaultErrorCode(err error) string {
+	var detailedErr autorest.DetailedError
+	if errors.As(err, &detailedErr) {
+		return fmt.Sprintf("%d", detailedErr.StatusCode)
+	}
+	return "unknown"
+}
@@ -0,0 +1,108 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/kubernetes-kms/pkg/config"
+	"github.com/Azure/kubernetes-kms/pkg/plugin/transit"
+)
+
+// defaultRotationGracePeriod is used when Rotation.PollIntervalSeconds is
+// set but Rotation.GracePeriodSeconds isn't, so enabling rotation doesn't
+// require tuning both knobs.
+const defaultRotationGracePeriod = 1 * time.Hour
+
+// NewClient constructs the Client for the backend selected by cfg.Backend,
+// validating that the fields required for that backend are set. Azure Key
+// Vault remains the default so existing configs that don't set Backend
+// continue to work unchanged.
+func NewClient(
+	ctx context.Context,
+	cfg *config.AzureConfig,
+	vaultName, keyName, keyVersion string,
+	proxyMode bool,
+	proxyAddress string,
+	proxyPort int,
+	managedHSM bool) (Client, error) {
+	backend, err := config.ValidateBackend(cfg.Backend)
+	if err != nil {
+		return nil, err
+	}
+
+	switch backend {
+	case config.BackendAzureKeyVault:
+		return newAzureKeyVaultClient(ctx, cfg, vaultName, keyName, keyVersion, proxyMode, proxyAddress, proxyPort, managedHSM)
+
+	case config.BackendVaultTransit:
+		return transit.New(ctx, transit.Config{
+			Address:             cfg.Transit.Address,
+			Namespace:           cfg.Transit.Namespace,
+			KeyName:             cfg.Transit.KeyName,
+			MountPath:           cfg.Transit.MountPath,
+			AuthMethod:          transit.AuthMethod(cfg.Transit.AuthMethod),
+			AppRoleMountPath:    cfg.Transit.AppRoleMountPath,
+			AppRoleID:           cfg.Transit.AppRoleID,
+			AppRoleSecretID:     cfg.Transit.AppRoleSecretID,
+			KubernetesMountPath: cfg.Transit.KubernetesMountPath,
+			KubernetesRole:      cfg.Transit.KubernetesRole,
+			KubernetesJWTPath:   cfg.Transit.KubernetesJWTPath,
+		})
+
+	default:
+		return nil, fmt.Errorf("unsupported backend: %s", backend)
+	}
+}
+
+// newAzureKeyVaultClient builds the primary Key Vault client along with a
+// KeyRing around it, so a config with no Rotation settings still gets the
+// one-entry ring every encrypt/decrypt path expects, and a config that
+// does set Rotation.PollIntervalSeconds gets a RotationController
+// actually running and promoting new key versions as they appear.
+func newAzureKeyVaultClient(
+	ctx context.Context,
+	cfg *config.AzureConfig,
+	vaultName, keyName, keyVersion string,
+	proxyMode bool,
+	proxyAddress string,
+	proxyPort int,
+	managedHSM bool) (*KeyRing, error) {
+	var primary *keyVaultClient
+	var err error
+	if cfg.KeyURI != "" {
+		primary, err = newKeyVaultClientFromURI(cfg, cfg.KeyURI, proxyMode, proxyAddress, proxyPort)
+	} else {
+		primary, err = newKeyVaultClient(cfg, vaultName, keyName, keyVersion, proxyMode, proxyAddress, proxyPort, managedHSM)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secondaries := make([]*keyVaultClient, 0, len(cfg.Rotation.SecondaryKeys))
+	for _, ref := range cfg.Rotation.SecondaryKeys {
+		secondary, err := newKeyVaultClient(cfg, ref.VaultName, ref.KeyName, ref.KeyVersion, proxyMode, proxyAddress, proxyPort, managedHSM)
+		if err != nil {
+			return nil, fmt.Errorf("failed to construct secondary key client for %s/%s, error: %+v", ref.VaultName, ref.KeyName, err)
+		}
+		secondaries = append(secondaries, secondary)
+	}
+
+	ring := NewKeyRing(primary, secondaries...)
+
+	if cfg.Rotation.PollIntervalSeconds > 0 {
+		gracePeriod := time.Duration(cfg.Rotation.GracePeriodSeconds) * time.Second
+		if gracePeriod <= 0 {
+			gracePeriod = defaultRotationGracePeriod
+		}
+		rc := NewRotationController(ring, time.Duration(cfg.Rotation.PollIntervalSeconds)*time.Second, gracePeriod)
+		go rc.Run(ctx)
+	}
+
+	return ring, nil
+}
@@ -0,0 +1,261 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
+)
+
+const (
+	// envelopeFormatVersion identifies the on-disk ciphertext layout so
+	// future formats remain decryptable.
+	envelopeFormatVersion byte = 0x01
+
+	// envelopeAlgoAESGCM identifies AES-256-GCM as the local content
+	// encryption algorithm used to seal the payload under the DEK.
+	envelopeAlgoAESGCM byte = 0x01
+
+	dekSizeBytes   = 32 // AES-256
+	gcmNonceBytes  = 12
+	wrappedLenSize = 2 // uint16 length prefix for the wrapped DEK
+
+	// maxEncryptionsPerDEK caps how many times a single cached DEK seals a
+	// payload before getOrCreateDEK forces a rewrap, regardless of how
+	// much of its TTL remains. Each seal picks a fresh random 96-bit GCM
+	// nonce, and NIST SP 800-38D recommends keeping random-nonce GCM
+	// invocations per key well under 2^32 to bound the chance of a
+	// collision; this cap stays far below that bound even at sustained
+	// high RPS for a long DEKCacheTTLSeconds.
+	maxEncryptionsPerDEK = 1 << 20
+
+	// unwrapCacheSweepEvery controls how often getOrUnwrapDEK
+	// opportunistically evicts expired unwrapCache entries. Entries are
+	// added on every cache miss and are otherwise only evicted when
+	// getOrCreateDEK wraps a new DEK, so without this sweep a process that
+	// mostly decrypts would keep growing the cache.
+	unwrapCacheSweepEvery = 256
+)
+
+// envelopeState holds the currently cached data-encryption key (DEK) used
+// for envelope encryption, along with a decrypt-side cache of previously
+// unwrapped DEKs so that repeated decrypts of recently-written ciphertext
+// don't require a Key Vault round trip for every call.
+type envelopeState struct {
+	mu sync.Mutex
+
+	ttl time.Duration
+
+	currentDEK           []byte
+	currentWrappedDEK    []byte
+	currentExpiresAt     time.Time
+	encryptionsSinceWrap int
+
+	unwrapCache    map[string]*unwrapCacheEntry
+	unwrapAccesses int
+}
+
+type unwrapCacheEntry struct {
+	dek       []byte
+	expiresAt time.Time
+}
+
+func newEnvelopeState(ttlSeconds int) *envelopeState {
+	return &envelopeState{
+		ttl:         time.Duration(ttlSeconds) * time.Second,
+		unwrapCache: make(map[string]*unwrapCacheEntry),
+	}
+}
+
+// encryptEnvelope generates (or reuses a cached) DEK and seals plain under
+// it with sealEnvelope.
+func (kvc *keyVaultClient) encryptEnvelope(ctx context.Context, plain []byte) ([]byte, error) {
+	dek, wrappedDEK, err := kvc.envelope.getOrCreateDEK(ctx, kvc.wrapKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain data encryption key, error: %+v", err)
+	}
+	return sealEnvelope(dek, wrappedDEK, plain)
+}
+
+// sealEnvelope encrypts plain locally with AES-256-GCM under dek and
+// returns a self-describing ciphertext of the form:
+// version || algoID || len(wrappedDEK) || wrappedDEK || nonce || sealed.
+// It has no Key Vault dependency, so it's the piece of the envelope format
+// that's unit tested directly.
+func sealEnvelope(dek, wrappedDEK, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct aes cipher, error: %+v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct gcm, error: %+v", err)
+	}
+
+	nonce := make([]byte, gcmNonceBytes)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce, error: %+v", err)
+	}
+	sealed := gcm.Seal(nil, nonce, plain, nil)
+
+	out := make([]byte, 0, 2+wrappedLenSize+len(wrappedDEK)+len(nonce)+len(sealed))
+	out = append(out, envelopeFormatVersion, envelopeAlgoAESGCM)
+	lenBuf := make([]byte, wrappedLenSize)
+	binary.BigEndian.PutUint16(lenBuf, uint16(len(wrappedDEK)))
+	out = append(out, lenBuf...)
+	out = append(out, wrappedDEK...)
+	out = append(out, nonce...)
+	out = append(out, sealed...)
+	return out, nil
+}
+
+// decryptEnvelope reverses encryptEnvelope, unwrapping the embedded DEK
+// (via cache when available) and opening the sealed payload with
+// openEnvelope.
+func (kvc *keyVaultClient) decryptEnvelope(ctx context.Context, data []byte) ([]byte, error) {
+	return openEnvelope(data, func(wrappedDEK []byte) ([]byte, error) {
+		return kvc.envelope.getOrUnwrapDEK(ctx, wrappedDEK, kvc.unwrapKey)
+	})
+}
+
+// openEnvelope parses the envelope format produced by sealEnvelope,
+// resolves the DEK for the embedded wrapped DEK via dekForWrapped, and
+// opens the sealed payload. Like sealEnvelope, it has no Key Vault
+// dependency.
+func openEnvelope(data []byte, dekForWrapped func(wrappedDEK []byte) ([]byte, error)) ([]byte, error) {
+	if len(data) < 2+wrappedLenSize {
+		return nil, fmt.Errorf("envelope ciphertext too short")
+	}
+	version, algoID := data[0], data[1]
+	if version != envelopeFormatVersion {
+		return nil, fmt.Errorf("unsupported envelope format version: %d", version)
+	}
+	if algoID != envelopeAlgoAESGCM {
+		return nil, fmt.Errorf("unsupported envelope content algorithm: %d", algoID)
+	}
+
+	wrappedLen := int(binary.BigEndian.Uint16(data[2 : 2+wrappedLenSize]))
+	offset := 2 + wrappedLenSize
+	if len(data) < offset+wrappedLen+gcmNonceBytes {
+		return nil, fmt.Errorf("envelope ciphertext truncated")
+	}
+	wrappedDEK := data[offset : offset+wrappedLen]
+	offset += wrappedLen
+	nonce := data[offset : offset+gcmNonceBytes]
+	offset += gcmNonceBytes
+	sealed := data[offset:]
+
+	dek, err := dekForWrapped(wrappedDEK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data encryption key, error: %+v", err)
+	}
+
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct aes cipher, error: %+v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct gcm, error: %+v", err)
+	}
+
+	plain, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sealed payload, error: %+v", err)
+	}
+	return plain, nil
+}
+
+// getOrCreateDEK returns the currently cached DEK and its wrapped form if
+// still within its TTL and under maxEncryptionsPerDEK uses, otherwise it
+// generates a new DEK, wraps it via wrapFn, and caches the result.
+func (e *envelopeState) getOrCreateDEK(ctx context.Context, wrapFn func(context.Context, []byte) ([]byte, error)) ([]byte, []byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.ttl > 0 && e.currentDEK != nil && time.Now().Before(e.currentExpiresAt) && e.encryptionsSinceWrap < maxEncryptionsPerDEK {
+		e.encryptionsSinceWrap++
+		metrics.ObserveCacheAccess(ctx, true)
+		return e.currentDEK, e.currentWrappedDEK, nil
+	}
+	metrics.ObserveCacheAccess(ctx, false)
+
+	dek := make([]byte, dekSizeBytes)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data encryption key, error: %+v", err)
+	}
+	wrapped, err := wrapFn(ctx, dek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A non-positive TTL means caching is disabled: every call wraps a
+	// fresh DEK instead of this being stored for reuse.
+	if e.ttl > 0 {
+		e.currentDEK = dek
+		e.currentWrappedDEK = wrapped
+		e.currentExpiresAt = time.Now().Add(e.ttl)
+		e.encryptionsSinceWrap = 1
+		e.unwrapCache[string(wrapped)] = &unwrapCacheEntry{dek: dek, expiresAt: e.currentExpiresAt}
+		e.sweepExpiredUnwrapCacheLocked()
+	}
+	return dek, wrapped, nil
+}
+
+// getOrUnwrapDEK returns the plaintext DEK for wrappedDEK from cache when
+// available, otherwise it unwraps it via unwrapFn and caches the result.
+func (e *envelopeState) getOrUnwrapDEK(ctx context.Context, wrappedDEK []byte, unwrapFn func(context.Context, []byte) ([]byte, error)) ([]byte, error) {
+	key := string(wrappedDEK)
+
+	if e.ttl > 0 {
+		e.mu.Lock()
+		e.unwrapAccesses++
+		if e.unwrapAccesses%unwrapCacheSweepEvery == 0 {
+			e.sweepExpiredUnwrapCacheLocked()
+		}
+		if entry, ok := e.unwrapCache[key]; ok && time.Now().Before(entry.expiresAt) {
+			e.mu.Unlock()
+			metrics.ObserveCacheAccess(ctx, true)
+			return entry.dek, nil
+		}
+		e.mu.Unlock()
+	}
+	metrics.ObserveCacheAccess(ctx, false)
+
+	dek, err := unwrapFn(ctx, wrappedDEK)
+	if err != nil {
+		return nil, err
+	}
+
+	// A non-positive TTL means caching is disabled: don't store the
+	// result, so every call unwraps through Key Vault again.
+	if e.ttl > 0 {
+		e.mu.Lock()
+		e.unwrapCache[key] = &unwrapCacheEntry{dek: dek, expiresAt: time.Now().Add(e.ttl)}
+		e.mu.Unlock()
+	}
+
+	return dek, nil
+}
+
+// sweepExpiredUnwrapCacheLocked deletes expired entries from
+// e.unwrapCache. The caller must hold e.mu.
+func (e *envelopeState) sweepExpiredUnwrapCacheLocked() {
+	now := time.Now()
+	for key, entry := range e.unwrapCache {
+		if now.After(entry.expiresAt) {
+			delete(e.unwrapCache, key)
+		}
+	}
+}
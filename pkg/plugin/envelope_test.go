@@ -0,0 +1,219 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSealOpenEnvelopeRoundTrip(t *testing.T) {
+	dek := bytes.Repeat([]byte{0x42}, dekSizeBytes)
+	wrappedDEK := []byte("wrapped-dek")
+	plain := []byte("super secret data")
+
+	sealed, err := sealEnvelope(dek, wrappedDEK, plain)
+	if err != nil {
+		t.Fatalf("sealEnvelope() error = %v", err)
+	}
+
+	opened, err := openEnvelope(sealed, func(gotWrapped []byte) ([]byte, error) {
+		if !bytes.Equal(gotWrapped, wrappedDEK) {
+			t.Fatalf("openEnvelope() wrappedDEK = %q, want %q", gotWrapped, wrappedDEK)
+		}
+		return dek, nil
+	})
+	if err != nil {
+		t.Fatalf("openEnvelope() error = %v", err)
+	}
+	if !bytes.Equal(opened, plain) {
+		t.Fatalf("openEnvelope() = %q, want %q", opened, plain)
+	}
+}
+
+func TestOpenEnvelopeRejectsTamperedVersion(t *testing.T) {
+	dek := bytes.Repeat([]byte{0x7}, dekSizeBytes)
+	sealed, err := sealEnvelope(dek, []byte("wrapped"), []byte("data"))
+	if err != nil {
+		t.Fatalf("sealEnvelope() error = %v", err)
+	}
+	sealed[0] = 0xff
+
+	if _, err := openEnvelope(sealed, func([]byte) ([]byte, error) { return dek, nil }); err == nil {
+		t.Fatal("openEnvelope() error = nil, want error for unsupported format version")
+	}
+}
+
+func TestOpenEnvelopeRejectsTruncatedCiphertext(t *testing.T) {
+	dek := bytes.Repeat([]byte{0x9}, dekSizeBytes)
+	sealed, err := sealEnvelope(dek, []byte("wrapped"), []byte("data"))
+	if err != nil {
+		t.Fatalf("sealEnvelope() error = %v", err)
+	}
+
+	if _, err := openEnvelope(sealed[:len(sealed)-1], func([]byte) ([]byte, error) { return dek, nil }); err == nil {
+		t.Fatal("openEnvelope() error = nil, want error for truncated ciphertext")
+	}
+}
+
+func TestEnvelopeStateGetOrCreateDEK(t *testing.T) {
+	t.Run("ttl<=0 disables caching", func(t *testing.T) {
+		e := newEnvelopeState(0)
+		calls := 0
+		wrapFn := func(_ context.Context, dek []byte) ([]byte, error) {
+			calls++
+			return append([]byte{}, dek...), nil
+		}
+
+		if _, _, err := e.getOrCreateDEK(context.Background(), wrapFn); err != nil {
+			t.Fatalf("getOrCreateDEK() error = %v", err)
+		}
+		if _, _, err := e.getOrCreateDEK(context.Background(), wrapFn); err != nil {
+			t.Fatalf("getOrCreateDEK() error = %v", err)
+		}
+		if calls != 2 {
+			t.Fatalf("wrapFn called %d times, want 2 (caching should be disabled)", calls)
+		}
+	})
+
+	t.Run("ttl>0 reuses cached DEK", func(t *testing.T) {
+		e := newEnvelopeState(60)
+		calls := 0
+		wrapFn := func(_ context.Context, dek []byte) ([]byte, error) {
+			calls++
+			return append([]byte{}, dek...), nil
+		}
+
+		dek1, _, err := e.getOrCreateDEK(context.Background(), wrapFn)
+		if err != nil {
+			t.Fatalf("getOrCreateDEK() error = %v", err)
+		}
+		dek2, _, err := e.getOrCreateDEK(context.Background(), wrapFn)
+		if err != nil {
+			t.Fatalf("getOrCreateDEK() error = %v", err)
+		}
+		if calls != 1 {
+			t.Fatalf("wrapFn called %d times, want 1 (cached DEK should be reused)", calls)
+		}
+		if !bytes.Equal(dek1, dek2) {
+			t.Fatal("getOrCreateDEK() returned different DEKs across calls within TTL")
+		}
+	})
+
+	t.Run("rewraps after maxEncryptionsPerDEK uses", func(t *testing.T) {
+		e := newEnvelopeState(60)
+		calls := 0
+		wrapFn := func(_ context.Context, dek []byte) ([]byte, error) {
+			calls++
+			return append([]byte{}, dek...), nil
+		}
+
+		for i := 0; i < maxEncryptionsPerDEK; i++ {
+			if _, _, err := e.getOrCreateDEK(context.Background(), wrapFn); err != nil {
+				t.Fatalf("getOrCreateDEK() error = %v", err)
+			}
+		}
+		if calls != 1 {
+			t.Fatalf("wrapFn called %d times, want 1 before hitting the cap", calls)
+		}
+
+		if _, _, err := e.getOrCreateDEK(context.Background(), wrapFn); err != nil {
+			t.Fatalf("getOrCreateDEK() error = %v", err)
+		}
+		if calls != 2 {
+			t.Fatalf("wrapFn called %d times, want 2 (should rewrap once the cap is hit)", calls)
+		}
+	})
+}
+
+func TestEnvelopeStateGetOrUnwrapDEK(t *testing.T) {
+	t.Run("ttl<=0 disables caching", func(t *testing.T) {
+		e := newEnvelopeState(0)
+		calls := 0
+		unwrapFn := func(_ context.Context, wrapped []byte) ([]byte, error) {
+			calls++
+			return append([]byte{}, wrapped...), nil
+		}
+
+		if _, err := e.getOrUnwrapDEK(context.Background(), []byte("wrapped"), unwrapFn); err != nil {
+			t.Fatalf("getOrUnwrapDEK() error = %v", err)
+		}
+		if _, err := e.getOrUnwrapDEK(context.Background(), []byte("wrapped"), unwrapFn); err != nil {
+			t.Fatalf("getOrUnwrapDEK() error = %v", err)
+		}
+		if calls != 2 {
+			t.Fatalf("unwrapFn called %d times, want 2 (caching should be disabled)", calls)
+		}
+	})
+
+	t.Run("ttl>0 reuses cached DEK", func(t *testing.T) {
+		e := newEnvelopeState(60)
+		calls := 0
+		unwrapFn := func(_ context.Context, wrapped []byte) ([]byte, error) {
+			calls++
+			return append([]byte{}, wrapped...), nil
+		}
+
+		if _, err := e.getOrUnwrapDEK(context.Background(), []byte("wrapped"), unwrapFn); err != nil {
+			t.Fatalf("getOrUnwrapDEK() error = %v", err)
+		}
+		if _, err := e.getOrUnwrapDEK(context.Background(), []byte("wrapped"), unwrapFn); err != nil {
+			t.Fatalf("getOrUnwrapDEK() error = %v", err)
+		}
+		if calls != 1 {
+			t.Fatalf("unwrapFn called %d times, want 1 (cached DEK should be reused)", calls)
+		}
+	})
+
+	t.Run("expired entry is refreshed", func(t *testing.T) {
+		e := newEnvelopeState(60)
+		e.unwrapCache["wrapped"] = &unwrapCacheEntry{dek: []byte("stale"), expiresAt: time.Now().Add(-time.Second)}
+		calls := 0
+		unwrapFn := func(_ context.Context, wrapped []byte) ([]byte, error) {
+			calls++
+			return []byte("fresh"), nil
+		}
+
+		dek, err := e.getOrUnwrapDEK(context.Background(), []byte("wrapped"), unwrapFn)
+		if err != nil {
+			t.Fatalf("getOrUnwrapDEK() error = %v", err)
+		}
+		if calls != 1 {
+			t.Fatalf("unwrapFn called %d times, want 1 (expired entry should be refreshed)", calls)
+		}
+		if string(dek) != "fresh" {
+			t.Fatalf("getOrUnwrapDEK() = %q, want %q", dek, "fresh")
+		}
+	})
+
+	t.Run("sweep evicts expired entries opportunistically", func(t *testing.T) {
+		e := newEnvelopeState(60)
+		e.unwrapCache["stale-1"] = &unwrapCacheEntry{dek: []byte("a"), expiresAt: time.Now().Add(-time.Second)}
+		e.unwrapCache["stale-2"] = &unwrapCacheEntry{dek: []byte("b"), expiresAt: time.Now().Add(-time.Second)}
+		e.unwrapCache["fresh"] = &unwrapCacheEntry{dek: []byte("c"), expiresAt: time.Now().Add(time.Hour)}
+		unwrapFn := func(_ context.Context, wrapped []byte) ([]byte, error) {
+			return append([]byte{}, wrapped...), nil
+		}
+
+		for i := 0; i < unwrapCacheSweepEvery; i++ {
+			if _, err := e.getOrUnwrapDEK(context.Background(), []byte("fresh"), unwrapFn); err != nil {
+				t.Fatalf("getOrUnwrapDEK() error = %v", err)
+			}
+		}
+
+		if _, ok := e.unwrapCache["stale-1"]; ok {
+			t.Fatal("sweep should have evicted expired entry \"stale-1\"")
+		}
+		if _, ok := e.unwrapCache["stale-2"]; ok {
+			t.Fatal("sweep should have evicted expired entry \"stale-2\"")
+		}
+		if _, ok := e.unwrapCache["fresh"]; !ok {
+			t.Fatal("sweep should not evict an unexpired entry")
+		}
+	})
+}
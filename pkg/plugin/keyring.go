@@ -0,0 +1,220 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// fingerprintLen is the number of prefix bytes of a key's fingerprint that
+// are embedded in ciphertext, letting Decrypt dispatch to the right
+// client in the ring without trial-and-error.
+const fingerprintLen = 8
+
+// keyFingerprint returns a short, stable identifier for a key derived
+// from its vault, name and version, used to tag ciphertext so it can be
+// routed back to the client that can decrypt it.
+func keyFingerprint(kvc *keyVaultClient) [fingerprintLen]byte {
+	sum := sha256.Sum256([]byte(kvc.KeyID()))
+	var fp [fingerprintLen]byte
+	copy(fp[:], sum[:fingerprintLen])
+	return fp
+}
+
+// KeyRing wraps one primary keyVaultClient used for encryption and any
+// number of secondary clients that remain usable for decryption, so a KEK
+// can be rotated without an immediate, synchronized config change across
+// every ciphertext already written with the old key.
+type KeyRing struct {
+	mu        sync.RWMutex
+	primary   *keyVaultClient
+	primaryFP [fingerprintLen]byte
+	secondary map[[fingerprintLen]byte]*keyVaultClient
+}
+
+// NewKeyRing returns a KeyRing that encrypts with primary and can decrypt
+// ciphertext produced by primary or any of secondaries. A config with a
+// single key continues to work unchanged by passing no secondaries.
+func NewKeyRing(primary *keyVaultClient, secondaries ...*keyVaultClient) *KeyRing {
+	kr := &KeyRing{
+		primary:   primary,
+		primaryFP: keyFingerprint(primary),
+		secondary: make(map[[fingerprintLen]byte]*keyVaultClient, len(secondaries)),
+	}
+	for _, s := range secondaries {
+		kr.secondary[keyFingerprint(s)] = s
+	}
+	return kr
+}
+
+// KeyID returns the identifier of the ring's current primary key.
+// Together with EncryptWithKeyID it makes KeyRing satisfy
+// VersionedClient; a bare keyVaultClient has KeyID but not
+// EncryptWithKeyID, so it does not.
+func (kr *KeyRing) KeyID() string {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.primary.KeyID()
+}
+
+// Encrypt encrypts plain with the ring's current primary key and prefixes
+// the result with that key's fingerprint.
+func (kr *KeyRing) Encrypt(ctx context.Context, plain []byte) ([]byte, error) {
+	cipher, _, err := kr.EncryptWithKeyID(ctx, plain)
+	return cipher, err
+}
+
+// EncryptWithKeyID behaves like Encrypt but additionally returns the
+// key_id of the exact primary key used for this call. This is the id the
+// KMS v2 API must tag its response with: reading the ring's current KeyID
+// after the fact would race a concurrent RotationController promotion and
+// could label ciphertext with a key_id that never touched it.
+func (kr *KeyRing) EncryptWithKeyID(ctx context.Context, plain []byte) ([]byte, string, error) {
+	kr.mu.RLock()
+	primary, fp := kr.primary, kr.primaryFP
+	kr.mu.RUnlock()
+
+	cipher, err := primary.Encrypt(ctx, plain)
+	if err != nil {
+		return nil, "", err
+	}
+
+	out := make([]byte, 0, fingerprintLen+len(cipher))
+	out = append(out, fp[:]...)
+	out = append(out, cipher...)
+	return out, primary.KeyID(), nil
+}
+
+// Decrypt reads the fingerprint prefix from data and dispatches to the
+// matching primary or secondary client.
+func (kr *KeyRing) Decrypt(ctx context.Context, data []byte) ([]byte, error) {
+	if len(data) < fingerprintLen {
+		return nil, fmt.Errorf("ciphertext too short to contain a key fingerprint")
+	}
+	var fp [fingerprintLen]byte
+	copy(fp[:], data[:fingerprintLen])
+	cipher := data[fingerprintLen:]
+
+	client, err := kr.clientFor(fp)
+	if err != nil {
+		return nil, err
+	}
+	return client.Decrypt(ctx, cipher)
+}
+
+// clientFor returns the client in the ring matching fp, checking the
+// primary first and then the secondaries.
+func (kr *KeyRing) clientFor(fp [fingerprintLen]byte) (*keyVaultClient, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	if fp == kr.primaryFP {
+		return kr.primary, nil
+	}
+	if client, ok := kr.secondary[fp]; ok {
+		return client, nil
+	}
+	return nil, fmt.Errorf("no key in ring matches ciphertext fingerprint %x", fp)
+}
+
+// promote makes newPrimary the ring's primary key, demoting the previous
+// primary to a secondary so ciphertext it already produced remains
+// decryptable.
+func (kr *KeyRing) promote(newPrimary *keyVaultClient) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	oldPrimary, oldFP := kr.primary, kr.primaryFP
+	kr.primary = newPrimary
+	kr.primaryFP = keyFingerprint(newPrimary)
+	kr.secondary[oldFP] = oldPrimary
+}
+
+// RotationController watches a KeyRing's primary key for a new version in
+// Key Vault and, once it has been available for at least gracePeriod,
+// promotes it to primary so operators can rotate KEKs without editing
+// config or taking downtime.
+type RotationController struct {
+	ring         *KeyRing
+	pollInterval time.Duration
+	gracePeriod  time.Duration
+
+	mu           sync.Mutex
+	pendingKeyID string
+	pendingSince time.Time
+}
+
+// NewRotationController returns a controller that polls ring's primary
+// key every pollInterval and promotes a newly observed version after it
+// has been continuously visible for gracePeriod.
+func NewRotationController(ring *KeyRing, pollInterval, gracePeriod time.Duration) *RotationController {
+	return &RotationController{ring: ring, pollInterval: pollInterval, gracePeriod: gracePeriod}
+}
+
+// Run blocks, polling for a new primary key version until ctx is
+// canceled.
+func (rc *RotationController) Run(ctx context.Context) {
+	ticker := time.NewTicker(rc.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := rc.checkForRotation(ctx); err != nil {
+				klog.ErrorS(err, "failed to check for key rotation")
+			}
+		}
+	}
+}
+
+func (rc *RotationController) checkForRotation(ctx context.Context) error {
+	rc.ring.mu.RLock()
+	primary := rc.ring.primary
+	rc.ring.mu.RUnlock()
+
+	latestKeyID, err := primary.LatestKeyID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get latest key version, error: %+v", err)
+	}
+	if latestKeyID == primary.KeyID() {
+		rc.mu.Lock()
+		rc.pendingKeyID = ""
+		rc.mu.Unlock()
+		return nil
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.pendingKeyID != latestKeyID {
+		rc.pendingKeyID = latestKeyID
+		rc.pendingSince = time.Now()
+		klog.InfoS("observed new key version, starting grace period before promotion", "keyID", latestKeyID, "gracePeriod", rc.gracePeriod)
+		return nil
+	}
+
+	if time.Since(rc.pendingSince) < rc.gracePeriod {
+		return nil
+	}
+
+	newPrimary, err := newKeyVaultClient(primary.config, primary.vaultName, primary.keyName, lastPathSegment(latestKeyID), primary.proxyMode, primary.proxyAddress, primary.proxyPort, primary.managedHSM)
+	if err != nil {
+		return fmt.Errorf("failed to construct client for rotated key, error: %+v", err)
+	}
+
+	klog.InfoS("promoting rotated key to primary", "keyID", latestKeyID)
+	rc.ring.promote(newPrimary)
+	rc.pendingKeyID = ""
+	return nil
+}
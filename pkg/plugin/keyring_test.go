@@ -0,0 +1,77 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"testing"
+)
+
+func TestKeyFingerprintStableAndDistinct(t *testing.T) {
+	a := &keyVaultClient{keyID: "vault/key/v1"}
+	b := &keyVaultClient{keyID: "vault/key/v1"}
+	c := &keyVaultClient{keyID: "vault/key/v2"}
+
+	if keyFingerprint(a) != keyFingerprint(b) {
+		t.Fatal("keyFingerprint() differs for clients with the same key_id")
+	}
+	if keyFingerprint(a) == keyFingerprint(c) {
+		t.Fatal("keyFingerprint() collided for clients with different key_id")
+	}
+}
+
+func TestKeyRingClientForDispatch(t *testing.T) {
+	primary := &keyVaultClient{keyID: "vault/key/primary"}
+	secondary := &keyVaultClient{keyID: "vault/key/secondary"}
+	ring := NewKeyRing(primary, secondary)
+
+	got, err := ring.clientFor(keyFingerprint(primary))
+	if err != nil {
+		t.Fatalf("clientFor(primary) error = %v", err)
+	}
+	if got != primary {
+		t.Fatal("clientFor(primary) did not return the primary client")
+	}
+
+	got, err = ring.clientFor(keyFingerprint(secondary))
+	if err != nil {
+		t.Fatalf("clientFor(secondary) error = %v", err)
+	}
+	if got != secondary {
+		t.Fatal("clientFor(secondary) did not return the secondary client")
+	}
+
+	unknown := &keyVaultClient{keyID: "vault/key/unknown"}
+	if _, err := ring.clientFor(keyFingerprint(unknown)); err == nil {
+		t.Fatal("clientFor(unknown) error = nil, want error")
+	}
+}
+
+func TestKeyRingDecryptRejectsShortCiphertext(t *testing.T) {
+	ring := NewKeyRing(&keyVaultClient{keyID: "vault/key/primary"})
+
+	if _, err := ring.Decrypt(context.Background(), make([]byte, fingerprintLen-1)); err == nil {
+		t.Fatal("Decrypt() error = nil, want error for ciphertext shorter than a fingerprint")
+	}
+}
+
+func TestKeyRingPromote(t *testing.T) {
+	primary := &keyVaultClient{keyID: "vault/key/v1"}
+	ring := NewKeyRing(primary)
+
+	rotated := &keyVaultClient{keyID: "vault/key/v2"}
+	ring.promote(rotated)
+
+	got, err := ring.clientFor(keyFingerprint(rotated))
+	if err != nil || got != rotated {
+		t.Fatal("promote() did not make the new key the ring's primary")
+	}
+
+	got, err = ring.clientFor(keyFingerprint(primary))
+	if err != nil || got != primary {
+		t.Fatal("promote() did not demote the old primary to an accessible secondary")
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/Azure/kubernetes-kms/pkg/auth"
 	"github.com/Azure/kubernetes-kms/pkg/config"
 	"github.com/Azure/kubernetes-kms/pkg/consts"
+	"github.com/Azure/kubernetes-kms/pkg/metrics"
 	"github.com/Azure/kubernetes-kms/pkg/utils"
 	"github.com/Azure/kubernetes-kms/pkg/version"
 
@@ -30,14 +31,133 @@ type Client interface {
 	Decrypt(ctx context.Context, plain []byte) ([]byte, error)
 }
 
+// VersionedClient is a Client that can also report the stable identifier
+// of the key it currently encrypts with. It is implemented by KeyRing and
+// consumed by the KMS v2 gRPC server, which needs key_id to detect
+// rotation and trigger storage migration.
+type VersionedClient interface {
+	Client
+
+	// KeyID returns the identifier of the key currently used to encrypt.
+	KeyID() string
+
+	// EncryptWithKeyID behaves like Encrypt but additionally returns the
+	// key_id of the exact key used for this call, so a caller can tag its
+	// response with the id that actually produced the ciphertext instead
+	// of calling KeyID() afterward and racing a concurrent key rotation.
+	EncryptWithKeyID(ctx context.Context, plain []byte) ([]byte, string, error)
+}
+
+// kvAPI is the subset of kv.BaseClient's methods keyVaultClient calls,
+// narrowed to an interface so tests can substitute a fake Key Vault
+// instead of making real network calls.
+type kvAPI interface {
+	GetKey(ctx context.Context, vaultBaseURL, keyName, keyVersion string) (kv.KeyBundle, error)
+	Encrypt(ctx context.Context, vaultBaseURL, keyName, keyVersion string, parameters kv.KeyOperationsParameters) (kv.KeyOperationResult, error)
+	Decrypt(ctx context.Context, vaultBaseURL, keyName, keyVersion string, parameters kv.KeyOperationsParameters) (kv.KeyOperationResult, error)
+	WrapKey(ctx context.Context, vaultBaseURL, keyName, keyVersion string, parameters kv.KeyOperationsParameters) (kv.KeyOperationResult, error)
+	UnwrapKey(ctx context.Context, vaultBaseURL, keyName, keyVersion string, parameters kv.KeyOperationsParameters) (kv.KeyOperationResult, error)
+}
+
 type keyVaultClient struct {
-	baseClient       kv.BaseClient
+	baseClient       kvAPI
 	config           *config.AzureConfig
 	vaultName        string
 	keyName          string
 	keyVersion       string
 	vaultURL         string
 	azureEnvironment *azure.Environment
+	managedHSM       bool
+	algorithm        kv.JSONWebKeyEncryptionAlgorithm
+	envelope         *envelopeState
+	keyID            string
+
+	// proxyMode, proxyAddress and proxyPort are the proxy settings this
+	// client was constructed with, kept around so a rotated replacement
+	// client (built by RotationController.checkForRotation) can be
+	// constructed with the same proxy configuration instead of silently
+	// reverting to talking to Key Vault directly.
+	proxyMode    bool
+	proxyAddress string
+	proxyPort    int
+}
+
+// KeyID returns a stable identifier for the key this client encrypts and
+// decrypts with, derived from the vault URL, key name and key version. It
+// never changes after construction, since keyVersion doesn't either: a
+// keyVaultClient always reports the id of the key it actually uses, so
+// the KMS v2 API can tag a response with the key that really produced it
+// instead of whatever version Key Vault happens to report as current by
+// the time the response is built. Detecting and acting on a newer
+// version is RotationController's job, via KeyRing.promote.
+func (kvc *keyVaultClient) KeyID() string {
+	return kvc.keyID
+}
+
+// metricsKeyAttributes returns the identifying attributes to record on
+// metrics and spans for operations performed by this client.
+func (kvc *keyVaultClient) metricsKeyAttributes() metrics.KeyAttributes {
+	return metrics.KeyAttributes{
+		VaultURL:   kvc.vaultURL,
+		KeyName:    kvc.keyName,
+		KeyVersion: kvc.keyVersion,
+		Algorithm:  string(kvc.algorithm),
+	}
+}
+
+// LatestKeyID checks Key Vault for the current enabled version of the
+// configured key and returns its key_id, without mutating kvc in any way:
+// this client keeps encrypting and decrypting with the version it was
+// constructed with until something actually swaps it out (see
+// RotationController.checkForRotation, which builds a new keyVaultClient
+// for the latest version and promotes it in the KeyRing). Callers compare
+// the returned value against KeyID() to detect that a newer version has
+// become available.
+func (kvc *keyVaultClient) LatestKeyID(ctx context.Context) (string, error) {
+	bundle, err := kvc.baseClient.GetKey(ctx, kvc.vaultURL, kvc.keyName, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to get key, error: %+v", err)
+	}
+	if bundle.Key == nil || bundle.Key.Kid == nil {
+		return "", fmt.Errorf("key bundle for %s missing kid", kvc.keyName)
+	}
+
+	latestVersion := lastPathSegment(*bundle.Key.Kid)
+	latestKeyID := keyIDFromParts(kvc.vaultURL, kvc.keyName, latestVersion)
+	if latestKeyID != kvc.keyID {
+		klog.InfoS("detected new key version", "keyName", kvc.keyName, "previous", kvc.keyID, "latest", latestKeyID)
+	}
+
+	return latestKeyID, nil
+}
+
+// lastPathSegment returns the final "/"-separated segment of a Key Vault
+// object identifier, e.g. the version from a key's kid URL.
+func lastPathSegment(s string) string {
+	parts := strings.Split(strings.TrimRight(s, "/"), "/")
+	return parts[len(parts)-1]
+}
+
+// keyIDFromParts builds the stable key identifier used for KMS v2's
+// key_id field from the components that uniquely identify a key version.
+func keyIDFromParts(vaultURL, keyName, keyVersion string) string {
+	return fmt.Sprintf("%s%s/%s", vaultURL, keyName, keyVersion)
+}
+
+// algorithmFromConfig maps a config.Algorithm to the Key Vault SDK's
+// algorithm type, defaulting to RSA15 for backwards compatibility with
+// configs that don't set Algorithm.
+func algorithmFromConfig(algo config.Algorithm) kv.JSONWebKeyEncryptionAlgorithm {
+	switch algo {
+	case config.AlgorithmRSAOAEP:
+		return kv.RSAOAEP
+	case config.AlgorithmRSAOAEP256:
+		return kv.RSAOAEP256
+	case config.AlgorithmA256KW:
+		return kv.A256KW
+	default:
+		return kv.RSA15
+	}
 }
 
 // NewKeyVaultClient returns a new key vault client to use for kms operations
@@ -91,7 +211,12 @@ func newKeyVaultClient(
 		vaultURL = getProxiedVaultURL(vaultURL, proxyAddress, proxyPort)
 	}
 
-	klog.InfoS("using kms key for encrypt/decrypt", "vaultURL", *vaultURL, "keyName", keyName, "keyVersion", keyVersion)
+	if err := validateAlgorithm(config.Algorithm, managedHSM); err != nil {
+		return nil, err
+	}
+	algorithm := algorithmFromConfig(config.Algorithm)
+
+	klog.InfoS("using kms key for encrypt/decrypt", "vaultURL", *vaultURL, "keyName", keyName, "keyVersion", keyVersion, "algorithm", algorithm)
 
 	client := &keyVaultClient{
 		baseClient:       kvClient,
@@ -101,39 +226,112 @@ func newKeyVaultClient(
 		keyVersion:       keyVersion,
 		vaultURL:         *vaultURL,
 		azureEnvironment: env,
+		managedHSM:       managedHSM,
+		algorithm:        algorithm,
+		keyID:            keyIDFromParts(*vaultURL, keyName, keyVersion),
+		proxyMode:        proxyMode,
+		proxyAddress:     proxyAddress,
+		proxyPort:        proxyPort,
+	}
+	if config.Envelope {
+		client.envelope = newEnvelopeState(config.DEKCacheTTLSeconds)
 	}
 	return client, nil
 }
 
+// validateAlgorithm ensures the configured algorithm is compatible with the
+// protection level of the target key. The accepted algorithm/HSM
+// combinations are defined once in config.ValidateAlgorithm; this just
+// delegates to it.
+func validateAlgorithm(algo config.Algorithm, managedHSM bool) error {
+	return config.ValidateAlgorithm(algo, managedHSM)
+}
+
 func (kvc *keyVaultClient) Encrypt(ctx context.Context, cipher []byte) ([]byte, error) {
+	ctx, done := metrics.ObserveRequest(ctx, "encrypt", kvc.metricsKeyAttributes(), len(cipher))
+	var err error
+	defer func() { done(err) }()
+
+	if kvc.envelope != nil {
+		var result []byte
+		result, err = kvc.encryptEnvelope(ctx, cipher)
+		return result, err
+	}
+
 	value := base64.RawURLEncoding.EncodeToString(cipher)
 
 	params := kv.KeyOperationsParameters{
-		Algorithm: kv.RSA15,
+		Algorithm: kvc.algorithm,
 		Value:     &value,
 	}
-	result, err := kvc.baseClient.Encrypt(ctx, kvc.vaultURL, kvc.keyName, kvc.keyVersion, params)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt, error: %+v", err)
+	result, encErr := kvc.baseClient.Encrypt(ctx, kvc.vaultURL, kvc.keyName, kvc.keyVersion, params)
+	if encErr != nil {
+		err = fmt.Errorf("failed to encrypt, error: %+v", encErr)
+		return nil, err
 	}
 	return []byte(*result.Result), nil
 }
 
 func (kvc *keyVaultClient) Decrypt(ctx context.Context, plain []byte) ([]byte, error) {
+	ctx, done := metrics.ObserveRequest(ctx, "decrypt", kvc.metricsKeyAttributes(), len(plain))
+	var err error
+	defer func() { done(err) }()
+
+	if kvc.envelope != nil {
+		var result []byte
+		result, err = kvc.decryptEnvelope(ctx, plain)
+		return result, err
+	}
+
 	value := string(plain)
 
 	params := kv.KeyOperationsParameters{
-		Algorithm: kv.RSA15,
+		Algorithm: kvc.algorithm,
 		Value:     &value,
 	}
 
-	result, err := kvc.baseClient.Decrypt(ctx, kvc.vaultURL, kvc.keyName, kvc.keyVersion, params)
+	result, decErr := kvc.baseClient.Decrypt(ctx, kvc.vaultURL, kvc.keyName, kvc.keyVersion, params)
+	if decErr != nil {
+		err = fmt.Errorf("failed to decrypt, error: %+v", decErr)
+		return nil, err
+	}
+	bytes, b64Err := base64.RawURLEncoding.DecodeString(*result.Result)
+	if b64Err != nil {
+		err = fmt.Errorf("failed to base64 decode result, error: %+v", b64Err)
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// wrapKey wraps raw key bytes (a DEK) through Key Vault using kvc's
+// configured algorithm, returning the opaque wrapped bytes.
+func (kvc *keyVaultClient) wrapKey(ctx context.Context, raw []byte) ([]byte, error) {
+	value := base64.RawURLEncoding.EncodeToString(raw)
+	params := kv.KeyOperationsParameters{
+		Algorithm: kvc.algorithm,
+		Value:     &value,
+	}
+	result, err := kvc.baseClient.WrapKey(ctx, kvc.vaultURL, kvc.keyName, kvc.keyVersion, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap key, error: %+v", err)
+	}
+	return []byte(*result.Result), nil
+}
+
+// unwrapKey reverses wrapKey, returning the original raw key bytes.
+func (kvc *keyVaultClient) unwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	value := string(wrapped)
+	params := kv.KeyOperationsParameters{
+		Algorithm: kvc.algorithm,
+		Value:     &value,
+	}
+	result, err := kvc.baseClient.UnwrapKey(ctx, kvc.vaultURL, kvc.keyName, kvc.keyVersion, params)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt, error: %+v", err)
+		return nil, fmt.Errorf("failed to unwrap key, error: %+v", err)
 	}
 	bytes, err := base64.RawURLEncoding.DecodeString(*result.Result)
 	if err != nil {
-		return nil, fmt.Errorf("failed to base64 decode result, error: %+v", err)
+		return nil, fmt.Errorf("failed to base64 decode unwrapped key, error: %+v", err)
 	}
 	return bytes, nil
 }
@@ -0,0 +1,253 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package transit implements the plugin.Client interface against
+// HashiCorp Vault's Transit secrets engine, giving users who don't run on
+// Azure a first-class KMS backend behind the same gRPC socket and
+// configuration surface as the Key Vault implementation.
+package transit
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"k8s.io/klog/v2"
+)
+
+// AuthMethod selects how the client logs in to Vault to obtain a token.
+type AuthMethod string
+
+const (
+	// AuthMethodAppRole logs in with a Vault AppRole role ID/secret ID pair.
+	AuthMethodAppRole AuthMethod = "approle"
+	// AuthMethodKubernetes logs in using the pod's projected service
+	// account token against Vault's kubernetes auth method.
+	AuthMethodKubernetes AuthMethod = "kubernetes"
+
+	defaultKubernetesJWTPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// renewBeforeExpiry is how far ahead of a lease's expiry the client
+	// attempts to renew it.
+	renewBeforeExpiry = 30 * time.Second
+
+	// reloginRetryInterval is how long the renew loop waits before trying
+	// again after both a renewal and a re-login attempt have failed.
+	reloginRetryInterval = 10 * time.Second
+)
+
+// Config configures a Transit Client.
+type Config struct {
+	// Address is the Vault server address, e.g. https://vault.example.com:8200.
+	Address string
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string
+	// KeyName is the name of the transit key to encrypt/decrypt with.
+	KeyName string
+	// MountPath is the path the transit secrets engine is mounted at.
+	// Defaults to "transit".
+	MountPath string
+
+	AuthMethod AuthMethod
+
+	// AppRole fields, required when AuthMethod is AuthMethodAppRole.
+	AppRoleMountPath string
+	AppRoleID        string
+	AppRoleSecretID  string
+
+	// Kubernetes auth fields, required when AuthMethod is AuthMethodKubernetes.
+	KubernetesMountPath string
+	KubernetesRole      string
+	KubernetesJWTPath   string
+}
+
+// Validate checks that the fields required for the configured AuthMethod
+// are set.
+func (c *Config) Validate() error {
+	if c.Address == "" {
+		return fmt.Errorf("vault address is required")
+	}
+	if c.KeyName == "" {
+		return fmt.Errorf("transit key name is required")
+	}
+	switch c.AuthMethod {
+	case AuthMethodAppRole:
+		if c.AppRoleID == "" || c.AppRoleSecretID == "" {
+			return fmt.Errorf("approle auth requires role_id and secret_id")
+		}
+	case AuthMethodKubernetes:
+		if c.KubernetesRole == "" {
+			return fmt.Errorf("kubernetes auth requires a role")
+		}
+	default:
+		return fmt.Errorf("unsupported auth method: %s", c.AuthMethod)
+	}
+	return nil
+}
+
+// Client encrypts and decrypts through a Vault Transit key, implementing
+// the same narrow interface as the Azure Key Vault client.
+type Client struct {
+	vc        *vaultapi.Client
+	cfg       Config
+	keyName   string
+	mountPath string
+
+	mu        sync.Mutex
+	renewStop chan struct{}
+}
+
+// New logs in to Vault with the auth method configured in cfg, starts a
+// background token renewer, and returns a Client ready to encrypt and
+// decrypt through cfg.KeyName.
+func New(ctx context.Context, cfg Config) (*Client, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid transit config, error: %+v", err)
+	}
+	if cfg.MountPath == "" {
+		cfg.MountPath = "transit"
+	}
+
+	vc, err := vaultapi.NewClient(&vaultapi.Config{Address: cfg.Address})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vault client, error: %+v", err)
+	}
+	if cfg.Namespace != "" {
+		vc.SetNamespace(cfg.Namespace)
+	}
+
+	secret, err := login(ctx, vc, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to authenticate to vault, error: %+v", err)
+	}
+	vc.SetToken(secret.Auth.ClientToken)
+
+	c := &Client{vc: vc, cfg: cfg, keyName: cfg.KeyName, mountPath: cfg.MountPath, renewStop: make(chan struct{})}
+	go c.renewLoop(ctx, secret)
+	return c, nil
+}
+
+// login authenticates to Vault with the configured auth method and
+// returns the resulting token secret.
+func login(ctx context.Context, vc *vaultapi.Client, cfg Config) (*vaultapi.Secret, error) {
+	switch cfg.AuthMethod {
+	case AuthMethodAppRole:
+		mountPath := cfg.AppRoleMountPath
+		if mountPath == "" {
+			mountPath = "approle"
+		}
+		return vc.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login", mountPath), map[string]interface{}{
+			"role_id":   cfg.AppRoleID,
+			"secret_id": cfg.AppRoleSecretID,
+		})
+
+	case AuthMethodKubernetes:
+		mountPath := cfg.KubernetesMountPath
+		if mountPath == "" {
+			mountPath = "kubernetes"
+		}
+		jwtPath := cfg.KubernetesJWTPath
+		if jwtPath == "" {
+			jwtPath = defaultKubernetesJWTPath
+		}
+		jwt, err := os.ReadFile(jwtPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account token from %s, error: %+v", jwtPath, err)
+		}
+		return vc.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login", mountPath), map[string]interface{}{
+			"role": cfg.KubernetesRole,
+			"jwt":  string(jwt),
+		})
+
+	default:
+		return nil, fmt.Errorf("unsupported auth method: %s", cfg.AuthMethod)
+	}
+}
+
+// renewLoop renews the client's token shortly before it expires, for as
+// long as the lease is renewable, re-authenticating from scratch if
+// renewal ever fails.
+func (c *Client) renewLoop(ctx context.Context, secret *vaultapi.Secret) {
+	wait := time.Duration(secret.Auth.LeaseDuration)*time.Second - renewBeforeExpiry
+	if wait <= 0 {
+		wait = time.Second
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.renewStop:
+			return
+		case <-time.After(wait):
+		}
+
+		renewed, err := c.vc.Auth().Token().RenewSelfWithContext(ctx, 0)
+		if err != nil {
+			klog.ErrorS(err, "failed to renew vault token, re-authenticating from scratch")
+			renewed, err = login(ctx, c.vc, c.cfg)
+			if err != nil {
+				klog.ErrorS(err, "failed to re-authenticate to vault, will retry", "retryInterval", reloginRetryInterval)
+				wait = reloginRetryInterval
+				continue
+			}
+		}
+		c.vc.SetToken(renewed.Auth.ClientToken)
+
+		wait = time.Duration(renewed.Auth.LeaseDuration)*time.Second - renewBeforeExpiry
+		if wait <= 0 {
+			wait = time.Second
+		}
+	}
+}
+
+// Close stops the background token renewer.
+func (c *Client) Close() {
+	close(c.renewStop)
+}
+
+// Encrypt encrypts plain (the parameter the Client interface names
+// cipher) through the configured transit key.
+func (c *Client) Encrypt(ctx context.Context, plain []byte) ([]byte, error) {
+	resp, err := c.vc.Logical().WriteWithContext(ctx, c.path("encrypt"), map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(plain),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt, error: %+v", err)
+	}
+	ciphertext, ok := resp.Data["ciphertext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("transit encrypt response missing ciphertext")
+	}
+	return []byte(ciphertext), nil
+}
+
+// Decrypt decrypts a Vault Transit ciphertext (the "vault:v1:..." format)
+// back into plaintext bytes.
+func (c *Client) Decrypt(ctx context.Context, cipher []byte) ([]byte, error) {
+	resp, err := c.vc.Logical().WriteWithContext(ctx, c.path("decrypt"), map[string]interface{}{
+		"ciphertext": string(cipher),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt, error: %+v", err)
+	}
+	encoded, ok := resp.Data["plaintext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("transit decrypt response missing plaintext")
+	}
+	plain, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to base64 decode plaintext, error: %+v", err)
+	}
+	return plain, nil
+}
+
+func (c *Client) path(op string) string {
+	return fmt.Sprintf("%s/%s/%s", c.mountPath, op, c.keyName)
+}
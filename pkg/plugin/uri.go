@@ -0,0 +1,71 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/kubernetes-kms/pkg/config"
+
+	"k8s.io/klog/v2"
+)
+
+// newKeyVaultClientFromURI builds a keyVaultClient from a single
+// azurekms:vault=...;name=... key URI instead of separate vault/key/version fields,
+// resolving the key's current enabled version against Key Vault when the
+// URI doesn't specify one.
+func newKeyVaultClientFromURI(
+	cfg *config.AzureConfig,
+	uri string,
+	proxyMode bool,
+	proxyAddress string,
+	proxyPort int) (*keyVaultClient, error) {
+	keyURI, err := config.ParseKeyURI(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key uri, error: %+v", err)
+	}
+
+	if keyURI.KeyVersion == "" {
+		// GetKey only needs a vault-scoped client; the key version isn't
+		// known yet, so a placeholder value is used and never dereferenced
+		// for encrypt/decrypt.
+		probe, err := newKeyVaultClient(cfg, keyURI.VaultName, keyURI.KeyName, "current", proxyMode, proxyAddress, proxyPort, keyURI.IsHSM())
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve current key version for %q, error: %+v", keyURI.KeyName, err)
+		}
+
+		version, err := resolveCurrentKeyVersion(context.Background(), probe)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve current key version for %q, error: %+v", keyURI.KeyName, err)
+		}
+		keyURI.KeyVersion = version
+	}
+
+	return newKeyVaultClient(cfg, keyURI.VaultName, keyURI.KeyName, keyURI.KeyVersion, proxyMode, proxyAddress, proxyPort, keyURI.IsHSM())
+}
+
+// resolveCurrentKeyVersion calls GetKey against probe to discover the
+// version Key Vault currently considers enabled for probe's key. It's
+// factored out from newKeyVaultClientFromURI, taking an already
+// constructed client instead of building one itself, so this lookup logic
+// can be unit tested against a fake baseClient without going through the
+// real Azure auth flow.
+func resolveCurrentKeyVersion(ctx context.Context, probe *keyVaultClient) (string, error) {
+	bundle, err := probe.baseClient.GetKey(ctx, probe.vaultURL, probe.keyName, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to get key, error: %+v", err)
+	}
+	if bundle.Key == nil || bundle.Key.Kid == nil {
+		return "", fmt.Errorf("key bundle for %s missing kid", probe.keyName)
+	}
+
+	if resolved, err := config.KeyURIFromKid(*bundle.Key.Kid); err == nil {
+		klog.V(4).InfoS("resolved key uri", "uri", resolved.String())
+	}
+
+	return lastPathSegment(*bundle.Key.Kid), nil
+}
@@ -0,0 +1,61 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	kv "github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
+)
+
+// fakeKVAPI is a kvAPI that only implements GetKey, which is all
+// resolveCurrentKeyVersion needs; the other methods aren't expected to be
+// called by these tests.
+type fakeKVAPI struct {
+	kvAPI
+	kid string
+	err error
+}
+
+func (f fakeKVAPI) GetKey(ctx context.Context, vaultBaseURL, keyName, keyVersion string) (kv.KeyBundle, error) {
+	if f.err != nil {
+		return kv.KeyBundle{}, f.err
+	}
+	if f.kid == "" {
+		return kv.KeyBundle{}, nil
+	}
+	kid := f.kid
+	return kv.KeyBundle{Key: &kv.JSONWebKey{Kid: &kid}}, nil
+}
+
+func TestResolveCurrentKeyVersion(t *testing.T) {
+	probe := &keyVaultClient{
+		baseClient: fakeKVAPI{kid: "https://myvault.vault.azure.net/keys/mykey/abcdef"},
+		vaultURL:   "https://myvault.vault.azure.net/",
+		keyName:    "mykey",
+	}
+
+	version, err := resolveCurrentKeyVersion(context.Background(), probe)
+	if err != nil {
+		t.Fatalf("resolveCurrentKeyVersion() error = %v", err)
+	}
+	if version != "abcdef" {
+		t.Fatalf("resolveCurrentKeyVersion() = %q, want %q", version, "abcdef")
+	}
+}
+
+func TestResolveCurrentKeyVersionMissingKid(t *testing.T) {
+	probe := &keyVaultClient{
+		baseClient: fakeKVAPI{kid: ""},
+		vaultURL:   "https://myvault.vault.azure.net/",
+		keyName:    "mykey",
+	}
+
+	if _, err := resolveCurrentKeyVersion(context.Background(), probe); err == nil {
+		t.Fatal("resolveCurrentKeyVersion() error = nil, want error for empty kid")
+	}
+}
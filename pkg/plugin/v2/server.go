@@ -0,0 +1,97 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// Package v2 implements the kube-apiserver KMS v2 gRPC contract on top of
+// the same plugin.Client used by the v1 server. Unlike v1, v2 requests and
+// responses carry a key_id so the apiserver can detect when the
+// underlying key has rotated and trigger storage migration. The backing
+// client is expected to be a plugin.KeyRing, whose RotationController
+// actually performs that rotation by promoting a new primary key; this
+// server only ever reports whatever key_id that client is using at the
+// moment of a given call.
+package v2
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Azure/kubernetes-kms/pkg/plugin"
+	"github.com/Azure/kubernetes-kms/pkg/version"
+
+	kmsv2 "k8s.io/kms/apis/v2"
+)
+
+const apiVersion = "v2"
+
+// Server implements kmsv2.KeyManagementServiceServer, adapting the
+// plugin's Client to the v2 encrypt/decrypt/status RPCs.
+type Server struct {
+	kmsv2.UnimplementedKeyManagementServiceServer
+
+	mu     sync.RWMutex
+	client plugin.VersionedClient
+}
+
+// New returns a v2 gRPC server backed by client.
+func New(client plugin.VersionedClient) *Server {
+	return &Server{client: client}
+}
+
+// Status reports the health of the plugin along with the key_id currently
+// in use for encryption, which the apiserver compares across calls to
+// detect rotation.
+func (s *Server) Status(ctx context.Context, _ *kmsv2.StatusRequest) (*kmsv2.StatusResponse, error) {
+	s.mu.RLock()
+	keyID := s.client.KeyID()
+	s.mu.RUnlock()
+
+	return &kmsv2.StatusResponse{
+		Version: apiVersion,
+		Healthz: "ok",
+		KeyId:   keyID,
+	}, nil
+}
+
+// Encrypt encrypts the plaintext payload and returns the ciphertext along
+// with the key_id of the key actually used for this call, so the
+// apiserver can record it in the encrypted object's annotations. It's
+// taken from the same EncryptWithKeyID call that produced the
+// ciphertext, not read back from the client afterward, so a concurrent
+// key rotation can never cause a mismatch between the two.
+func (s *Server) Encrypt(ctx context.Context, req *kmsv2.EncryptRequest) (*kmsv2.EncryptResponse, error) {
+	s.mu.RLock()
+	client := s.client
+	s.mu.RUnlock()
+
+	cipher, keyID, err := client.EncryptWithKeyID(ctx, req.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt, error: %+v", err)
+	}
+
+	return &kmsv2.EncryptResponse{
+		Ciphertext: cipher,
+		KeyId:      keyID,
+		Annotations: map[string][]byte{
+			"kubernetes-kms.azure.com/version": []byte(version.GetUserAgent()),
+		},
+	}, nil
+}
+
+// Decrypt decrypts the ciphertext. The request's key_id is informational
+// only: dispatch to the right key happens via the fingerprint plugin.KeyRing
+// embeds in the ciphertext itself, which survives key rotation even if the
+// apiserver's key_id bookkeeping ever fell out of sync.
+func (s *Server) Decrypt(ctx context.Context, req *kmsv2.DecryptRequest) (*kmsv2.DecryptResponse, error) {
+	s.mu.RLock()
+	client := s.client
+	s.mu.RUnlock()
+
+	plain, err := client.Decrypt(ctx, req.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt, error: %+v", err)
+	}
+	return &kmsv2.DecryptResponse{Plaintext: plain}, nil
+}